@@ -0,0 +1,290 @@
+// Lophiid distributed honeypot
+// Copyright (C) 2024 Niels Heinen
+//
+// This program is free software; you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the
+// Free Software Foundation; either version 2 of the License, or (at your
+// option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of MERCHANTABILITY
+// or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License
+// for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, write to the Free Software Foundation, Inc.,
+// 59 Temple Place, Suite 330, Boston, MA 02111-1307 USA
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"lophiid/pkg/database/models"
+	"sort"
+	"sync"
+	"time"
+)
+
+var ErrNoPeerAvailable = errors.New("no peer available for key")
+
+// ErrClusterLimitExceeded is returned when the owning peer (or, for a
+// promoted key, the locally tracked remaining quota) reports that a key is
+// over its limit. It deliberately doesn't distinguish IP keys from URI keys,
+// since both are forwarded through the same hit() path and a single peer
+// bucket is the sole authority either way.
+var ErrClusterLimitExceeded = errors.New("cluster rate limit exceeded")
+
+var _ RateLimiter = (*ClusterRateLimiter)(nil)
+
+// PeerRateLimitClient is how a ClusterRateLimiter talks to the peer that
+// owns a given key. Production code is expected to back this with a gRPC
+// client, in the spirit of gubernator's peer protocol; tests can supply a
+// fake.
+type PeerRateLimitClient interface {
+	// Hit asks peer to atomically add n to the bucket for key and reports
+	// whether the caller is still within limit plus how many hits remain
+	// before the limit is reached.
+	Hit(ctx context.Context, peer string, key string, n int64) (allowed bool, remaining int64, err error)
+}
+
+// ConsistentHashRing shards keys across a set of peer addresses using
+// consistent hashing with virtual replicas, so that a given key is (absent
+// membership changes) always owned by the same peer.
+type ConsistentHashRing struct {
+	mu           sync.RWMutex
+	replicas     int
+	ring         map[uint32]string
+	sortedHashes []uint32
+}
+
+// NewConsistentHashRing creates a ring with replicas virtual nodes per peer
+// and populates it with peers.
+func NewConsistentHashRing(replicas int, peers []string) *ConsistentHashRing {
+	c := &ConsistentHashRing{replicas: replicas}
+	c.SetPeers(peers)
+	return c
+}
+
+// SetPeers replaces the ring's membership. Existing key ownership is
+// recomputed on the next call to PeerFor.
+func (c *ConsistentHashRing) SetPeers(peers []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.ring = make(map[uint32]string)
+	c.sortedHashes = make([]uint32, 0, len(peers)*c.replicas)
+
+	for _, peer := range peers {
+		for i := 0; i < c.replicas; i++ {
+			h := crc32.ChecksumIEEE([]byte(fmt.Sprintf("%s-%d", peer, i)))
+			c.ring[h] = peer
+			c.sortedHashes = append(c.sortedHashes, h)
+		}
+	}
+
+	sort.Slice(c.sortedHashes, func(i, j int) bool { return c.sortedHashes[i] < c.sortedHashes[j] })
+}
+
+// PeerFor returns the peer address that owns key, or "" if the ring has no
+// peers.
+func (c *ConsistentHashRing) PeerFor(key string) string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if len(c.sortedHashes) == 0 {
+		return ""
+	}
+
+	h := crc32.ChecksumIEEE([]byte(key))
+	idx := sort.Search(len(c.sortedHashes), func(i int) bool { return c.sortedHashes[i] >= h })
+	if idx == len(c.sortedHashes) {
+		idx = 0
+	}
+
+	return c.ring[c.sortedHashes[idx]]
+}
+
+// GlobalBehaviorConfig controls the async batching ("global" behavior, in
+// gubernator terms) used for high traffic keys, where a small amount of
+// staleness is an acceptable trade for avoiding a network round trip on
+// every request.
+type GlobalBehaviorConfig struct {
+	// FlushInterval is how often a batched key's accumulated hits are
+	// pushed to its owning peer, and how often the promotion decision
+	// below is re-evaluated. Zero disables batching.
+	FlushInterval time.Duration
+	// HitThreshold is the number of hits a key needs to accumulate
+	// locally within a FlushInterval before it is promoted to batched
+	// mode, where further hits are accumulated locally and flushed
+	// periodically instead of forwarded synchronously on every request.
+	HitThreshold int64
+}
+
+// ClusterRateLimiter shards rate limit keys across the honeypot fleet using
+// a consistent hash ring. The peer that owns a key is the sole authority
+// for its bucket; every backend forwards hits for that key to the owner.
+// Both the per-IP key (HoneypotIP-Port-SourceIP) and the per-URI key
+// (BaseHash) are forwarded, mirroring WindowRateLimiter's IP+URI checks.
+// Keys that see a lot of traffic are batched locally and flushed
+// periodically instead of round-tripping to the owner on every request.
+type ClusterRateLimiter struct {
+	Client   PeerRateLimitClient
+	Ring     *ConsistentHashRing
+	Behavior GlobalBehaviorConfig
+
+	mu        sync.Mutex
+	localHits map[string]int64 // hits seen locally since the last flush, used to decide when a key crosses HitThreshold
+	pending   map[string]int64 // hits accumulated for keys that have been promoted to batched mode
+	remaining map[string]int64 // last remaining quota the owning peer reported for a key, used to cap optimistic allows while promoted
+}
+
+// NewClusterRateLimiter creates a ClusterRateLimiter that forwards hits
+// through client, sharded via ring. If behavior.FlushInterval is non-zero a
+// background goroutine periodically flushes batched keys.
+func NewClusterRateLimiter(client PeerRateLimitClient, ring *ConsistentHashRing, behavior GlobalBehaviorConfig) *ClusterRateLimiter {
+	c := &ClusterRateLimiter{
+		Client:    client,
+		Ring:      ring,
+		Behavior:  behavior,
+		localHits: make(map[string]int64),
+		pending:   make(map[string]int64),
+		remaining: make(map[string]int64),
+	}
+
+	if behavior.FlushInterval > 0 {
+		go c.flushLoop()
+	}
+
+	return c
+}
+
+// AllowRequest forwards the hit for req's IP key and URI key to whichever
+// peer owns each, mirroring WindowRateLimiter's AllowRequest.
+func (c *ClusterRateLimiter) AllowRequest(req *models.Request) (bool, error) {
+	if allowed, err := c.hit(keyForIPRequest(req)); !allowed {
+		return false, err
+	}
+
+	if allowed, err := c.hit(req.BaseHash); !allowed {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// hit records a hit for key. With batching enabled (a non-zero
+// Behavior.FlushInterval), every call counts towards localHits, which
+// decides when the key crosses Behavior.HitThreshold; once it does, further
+// hits are accumulated in pending instead of round-tripping to the owning
+// peer on every request. A promoted key is only allowed as long as its
+// accumulated pending hits stay within the last remaining quota the peer
+// reported; once that budget would be exceeded it's denied locally rather
+// than allowed to run up an unbounded debt until the next flush. A key that
+// has just been promoted and has no known remaining quota yet (e.g.
+// HitThreshold is 0, so the very first hit promotes it) falls through to a
+// synchronous peer call instead of being denied against a zero baseline.
+func (c *ClusterRateLimiter) hit(key string) (bool, error) {
+	owner := c.Ring.PeerFor(key)
+	if owner == "" {
+		return false, ErrNoPeerAvailable
+	}
+
+	// localHits/remaining only need to be tracked when batching is
+	// enabled; with it off every hit is forwarded synchronously below, so
+	// leaving these maps untouched keeps per-key bookkeeping from
+	// accumulating forever for a config that never reads it.
+	batching := c.Behavior.FlushInterval > 0
+
+	if batching {
+		c.mu.Lock()
+		c.localHits[key]++
+		promoted := c.localHits[key] > c.Behavior.HitThreshold
+		if promoted {
+			if remaining, known := c.remaining[key]; known {
+				if c.pending[key]+1 > remaining {
+					c.mu.Unlock()
+					return false, ErrClusterLimitExceeded
+				}
+				c.pending[key]++
+				c.mu.Unlock()
+				return true, nil
+			}
+		}
+		c.mu.Unlock()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	allowed, remaining, err := c.Client.Hit(ctx, owner, key, 1)
+	if err != nil {
+		return false, err
+	}
+
+	if batching {
+		c.mu.Lock()
+		c.remaining[key] = remaining
+		c.mu.Unlock()
+	}
+
+	if !allowed {
+		return false, ErrClusterLimitExceeded
+	}
+
+	return true, nil
+}
+
+// Tick flushes any pending batched hits to their owning peers and resets
+// the promotion window, so keys that have gone quiet can demote back to
+// synchronous forwarding. Callers normally rely on the background flush
+// loop started by NewClusterRateLimiter; Tick lets tests and non-batching
+// callers trigger this deterministically. It also satisfies the
+// RateLimiter interface.
+func (c *ClusterRateLimiter) Tick() {
+	c.flushPending()
+}
+
+func (c *ClusterRateLimiter) flushLoop() {
+	ticker := time.NewTicker(c.Behavior.FlushInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		c.flushPending()
+	}
+}
+
+func (c *ClusterRateLimiter) flushPending() {
+	c.mu.Lock()
+	batch := c.pending
+	c.pending = make(map[string]int64)
+	c.localHits = make(map[string]int64)
+	c.remaining = make(map[string]int64)
+	c.mu.Unlock()
+
+	for key, n := range batch {
+		if n == 0 {
+			continue
+		}
+
+		owner := c.Ring.PeerFor(key)
+		if owner == "" {
+			continue
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		// Best effort: on error the hits accumulated so far for this
+		// key are dropped rather than retried, so a single unreachable
+		// peer can't stall the flush loop.
+		_, remaining, err := c.Client.Hit(ctx, owner, key, n)
+		cancel()
+		if err != nil {
+			continue
+		}
+
+		c.mu.Lock()
+		c.remaining[key] = remaining
+		c.mu.Unlock()
+	}
+}
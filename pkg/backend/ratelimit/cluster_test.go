@@ -0,0 +1,251 @@
+// Lophiid distributed honeypot
+// Copyright (C) 2024 Niels Heinen
+//
+// This program is free software; you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the
+// Free Software Foundation; either version 2 of the License, or (at your
+// option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of MERCHANTABILITY
+// or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License
+// for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, write to the Free Software Foundation, Inc.,
+// 59 Temple Place, Suite 330, Boston, MA 02111-1307 USA
+package ratelimit
+
+import (
+	"context"
+	"lophiid/pkg/database/models"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestConsistentHashRingStableOwnership(t *testing.T) {
+	ring := NewConsistentHashRing(10, []string{"peer-a:9000", "peer-b:9000", "peer-c:9000"})
+
+	key := "1.1.1.1-31337-2.2.2.2"
+	owner := ring.PeerFor(key)
+	if owner == "" {
+		t.Fatalf("expected a peer to own %q", key)
+	}
+
+	for i := 0; i < 10; i++ {
+		if got := ring.PeerFor(key); got != owner {
+			t.Errorf("PeerFor(%q) = %q on repeat call, want stable %q", key, got, owner)
+		}
+	}
+}
+
+func TestConsistentHashRingNoPeers(t *testing.T) {
+	ring := NewConsistentHashRing(10, nil)
+	if got := ring.PeerFor("some-key"); got != "" {
+		t.Errorf("PeerFor() with no peers = %q, want empty string", got)
+	}
+}
+
+// fakePeerClient simulates a peer that enforces a per-key limit and reports
+// back the remaining quota, same as the real gRPC-backed implementation
+// would.
+type fakePeerClient struct {
+	hits  map[string]int64
+	limit int64 // 0 means unlimited
+}
+
+func (f *fakePeerClient) Hit(_ context.Context, _ string, key string, n int64) (bool, int64, error) {
+	f.hits[key] += n
+	if f.limit == 0 {
+		return true, math.MaxInt64, nil
+	}
+
+	remaining := f.limit - f.hits[key]
+	if remaining < 0 {
+		remaining = 0
+	}
+	return f.hits[key] <= f.limit, remaining, nil
+}
+
+func TestClusterRateLimiterForwardsHits(t *testing.T) {
+	client := &fakePeerClient{hits: make(map[string]int64)}
+	ring := NewConsistentHashRing(10, []string{"peer-a:9000"})
+	c := NewClusterRateLimiter(client, ring, GlobalBehaviorConfig{})
+
+	req := &models.Request{HoneypotIP: "10.0.0.1", Port: 8080, SourceIP: "192.168.1.1"}
+
+	allowed, err := c.AllowRequest(req)
+	if !allowed || err != nil {
+		t.Fatalf("AllowRequest() = %v, %v, want true, nil", allowed, err)
+	}
+
+	key := keyForIPRequest(req)
+	if client.hits[key] != 1 {
+		t.Errorf("expected 1 forwarded hit for %q, got %d", key, client.hits[key])
+	}
+}
+
+func TestClusterRateLimiterForwardsURIHits(t *testing.T) {
+	client := &fakePeerClient{hits: make(map[string]int64)}
+	ring := NewConsistentHashRing(10, []string{"peer-a:9000"})
+	c := NewClusterRateLimiter(client, ring, GlobalBehaviorConfig{})
+
+	req := &models.Request{HoneypotIP: "10.0.0.1", Port: 8080, SourceIP: "192.168.1.1", BaseHash: "hash1"}
+
+	allowed, err := c.AllowRequest(req)
+	if !allowed || err != nil {
+		t.Fatalf("AllowRequest() = %v, %v, want true, nil", allowed, err)
+	}
+
+	if client.hits["hash1"] != 1 {
+		t.Errorf("expected 1 forwarded hit for the URI key %q, got %d", "hash1", client.hits["hash1"])
+	}
+}
+
+func TestClusterRateLimiterPromotesHighTrafficKeysToBatching(t *testing.T) {
+	client := &fakePeerClient{hits: make(map[string]int64)}
+	ring := NewConsistentHashRing(10, []string{"peer-a:9000"})
+	// A FlushInterval of an hour keeps the background loop from firing
+	// during the test while staying non-zero so the promotion logic is
+	// active; Tick() is called manually below.
+	c := NewClusterRateLimiter(client, ring, GlobalBehaviorConfig{FlushInterval: time.Hour, HitThreshold: 2})
+
+	req := &models.Request{HoneypotIP: "10.0.0.1", Port: 8080, SourceIP: "192.168.1.1"}
+	key := keyForIPRequest(req)
+
+	// The first HitThreshold hits are still forwarded synchronously.
+	for i := 0; i < 2; i++ {
+		if allowed, err := c.AllowRequest(req); !allowed || err != nil {
+			t.Fatalf("hit %d should be allowed synchronously, got %v, %v", i, allowed, err)
+		}
+	}
+	if client.hits[key] != 2 {
+		t.Fatalf("expected 2 synchronous hits before crossing HitThreshold, got %d", client.hits[key])
+	}
+
+	// Crossing HitThreshold promotes the key: further hits are batched
+	// locally instead of forwarded synchronously.
+	for i := 0; i < 5; i++ {
+		if allowed, err := c.AllowRequest(req); !allowed || err != nil {
+			t.Fatalf("batched hit %d should be allowed, got %v, %v", i, allowed, err)
+		}
+	}
+	if client.hits[key] != 2 {
+		t.Errorf("expected no additional synchronous hits once the key is batched, got %d", client.hits[key])
+	}
+
+	c.Tick()
+	if client.hits[key] != 7 {
+		t.Errorf("expected Tick() to flush the 5 batched hits on top of the 2 synchronous ones, got %d", client.hits[key])
+	}
+}
+
+// TestClusterRateLimiterPromotedKeyRespectsPeerRemaining guards against
+// promoted keys being allowed unconditionally until the next flush: once the
+// pending batch would exceed the remaining quota last reported by the owning
+// peer, further hits must be denied locally instead of optimistically
+// allowed.
+func TestClusterRateLimiterPromotedKeyRespectsPeerRemaining(t *testing.T) {
+	client := &fakePeerClient{hits: make(map[string]int64), limit: 5}
+	ring := NewConsistentHashRing(10, []string{"peer-a:9000"})
+	c := NewClusterRateLimiter(client, ring, GlobalBehaviorConfig{FlushInterval: time.Hour, HitThreshold: 2})
+
+	req := &models.Request{HoneypotIP: "10.0.0.1", Port: 8080, SourceIP: "192.168.1.1"}
+	key := keyForIPRequest(req)
+
+	// The first 2 hits are synchronous: 2 used, 3 remaining of the peer's
+	// limit of 5.
+	for i := 0; i < 2; i++ {
+		if allowed, err := c.AllowRequest(req); !allowed || err != nil {
+			t.Fatalf("hit %d should be allowed synchronously, got %v, %v", i, allowed, err)
+		}
+	}
+
+	// The key is now promoted. It may be allowed optimistically only up to
+	// the 3 hits remaining in the peer's last known quota.
+	for i := 0; i < 3; i++ {
+		if allowed, err := c.AllowRequest(req); !allowed || err != nil {
+			t.Fatalf("promoted hit %d should still be within the peer's remaining quota, got %v, %v", i, allowed, err)
+		}
+	}
+
+	allowed, err := c.AllowRequest(req)
+	if allowed {
+		t.Errorf("promoted hit exceeding the peer's remaining quota should be denied locally")
+	}
+	if err != ErrClusterLimitExceeded {
+		t.Errorf("expected ErrClusterLimitExceeded, got %v", err)
+	}
+
+	if client.hits[key] != 2 {
+		t.Errorf("denied promoted hits must not be forwarded to the peer before the next flush, got %d", client.hits[key])
+	}
+}
+
+// denyingKeyClient allows every key except deniedKey, which it rejects from
+// the first hit onward. It isolates a rejection to a single key so tests can
+// tell which of AllowRequest's two hit() calls (IP key vs URI key) produced
+// it.
+type denyingKeyClient struct {
+	deniedKey string
+}
+
+func (d *denyingKeyClient) Hit(_ context.Context, _ string, key string, _ int64) (bool, int64, error) {
+	if key == d.deniedKey {
+		return false, 0, nil
+	}
+	return true, math.MaxInt64, nil
+}
+
+// TestClusterRateLimiterZeroHitThresholdStillForwardsHits guards against a
+// HitThreshold of 0 (promote a key on its very first hit) denying every hit
+// forever: before any synchronous call has established a remaining quota,
+// hits must still reach the peer instead of being compared against an
+// unset-but-zero-valued budget.
+func TestClusterRateLimiterZeroHitThresholdStillForwardsHits(t *testing.T) {
+	client := &fakePeerClient{hits: make(map[string]int64), limit: 5}
+	ring := NewConsistentHashRing(10, []string{"peer-a:9000"})
+	c := NewClusterRateLimiter(client, ring, GlobalBehaviorConfig{FlushInterval: time.Hour, HitThreshold: 0})
+
+	req := &models.Request{HoneypotIP: "10.0.0.1", Port: 8080, SourceIP: "192.168.1.1"}
+	key := keyForIPRequest(req)
+
+	for i := 0; i < 5; i++ {
+		if allowed, err := c.AllowRequest(req); !allowed || err != nil {
+			t.Fatalf("hit %d should be allowed, within the peer's limit of 5, got %v, %v", i, allowed, err)
+		}
+	}
+
+	allowed, err := c.AllowRequest(req)
+	if allowed {
+		t.Errorf("6th hit should exceed the peer's limit of 5")
+	}
+	if err != ErrClusterLimitExceeded {
+		t.Errorf("expected ErrClusterLimitExceeded, got %v", err)
+	}
+
+	if client.hits[key] == 0 {
+		t.Errorf("hits must still reach the peer when HitThreshold is 0, got 0 forwarded hits")
+	}
+}
+
+// TestClusterRateLimiterURIKeyDenialReturnsClusterError guards against the
+// per-IP sentinel error being hardcoded for URI-key rejections too: a denial
+// on req.BaseHash must surface the same key-agnostic ErrClusterLimitExceeded,
+// not ErrIPWindowLimitExceeded.
+func TestClusterRateLimiterURIKeyDenialReturnsClusterError(t *testing.T) {
+	client := &denyingKeyClient{deniedKey: "hash1"}
+	ring := NewConsistentHashRing(10, []string{"peer-a:9000"})
+	c := NewClusterRateLimiter(client, ring, GlobalBehaviorConfig{})
+
+	req := &models.Request{HoneypotIP: "10.0.0.1", Port: 8080, SourceIP: "192.168.1.1", BaseHash: "hash1"}
+
+	allowed, err := c.AllowRequest(req)
+	if allowed {
+		t.Fatalf("request should be rejected, the URI key is over its peer-side limit")
+	}
+	if err != ErrClusterLimitExceeded {
+		t.Errorf("expected ErrClusterLimitExceeded for a URI-key rejection, got %v", err)
+	}
+}
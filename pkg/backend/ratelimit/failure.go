@@ -0,0 +1,125 @@
+// Lophiid distributed honeypot
+// Copyright (C) 2024 Niels Heinen
+//
+// This program is free software; you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the
+// Free Software Foundation; either version 2 of the License, or (at your
+// option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of MERCHANTABILITY
+// or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License
+// for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, write to the Free Software Foundation, Inc.,
+// 59 Temple Place, Suite 330, Boston, MA 02111-1307 USA
+package ratelimit
+
+import (
+	"lophiid/pkg/database/models"
+	"sync"
+	"time"
+)
+
+// FailureToken is handed back by FailureRateLimiter.AllowRequest. The caller
+// must Commit it once the honeypot knows whether the request turned out to
+// be benign or a failure/probe.
+type FailureToken struct {
+	limiter *FailureRateLimiter
+	key     string
+}
+
+// Commit finalizes the token. Successful requests are never counted against
+// their source IP; failed ones register a hit that tightens that IP's
+// bucket.
+func (t *FailureToken) Commit(success bool) {
+	if success {
+		return
+	}
+	t.limiter.registerFailure(t.key)
+}
+
+// FailureRateLimiter only throttles a source IP once it starts producing
+// failed or malicious requests (rule matches, malformed requests, repeated
+// 404 probing, ...). Well-behaved scanners and researchers are left alone
+// since normal requests are never counted. Callers use the two-phase
+// AllowRequest/Commit API: AllowRequest checks the IP against its current
+// bucket (if any), the honeypot handles the request, and then the returned
+// FailureToken.Commit persists the outcome.
+type FailureRateLimiter struct {
+	MaxRequestsPerWindow int
+	MaxRequestsPerBucket int
+
+	mu      sync.Mutex
+	inner   *WindowRateLimiter
+	metrics *RateLimiterMetrics
+}
+
+// NewFailureRateLimiter creates a FailureRateLimiter that, once a source IP
+// has registered its first failure, caps it at maxRequestsPerBucket
+// failures per bucketDuration and maxRequestsPerWindow per window.
+func NewFailureRateLimiter(window time.Duration, bucketDuration time.Duration, maxRequestsPerWindow int, maxRequestsPerBucket int, metrics *RateLimiterMetrics) *FailureRateLimiter {
+	return &FailureRateLimiter{
+		MaxRequestsPerWindow: maxRequestsPerWindow,
+		MaxRequestsPerBucket: maxRequestsPerBucket,
+		inner:                NewWindowRateLimiter(window, bucketDuration, maxRequestsPerWindow, maxRequestsPerBucket, 0, 0, metrics),
+		metrics:              metrics,
+	}
+}
+
+// AllowRequest returns whether req's source IP is currently allowed through
+// and a FailureToken the caller must Commit once the request has been
+// handled. IPs with no recorded failures are always allowed and don't get a
+// bucket until their first failure.
+func (f *FailureRateLimiter) AllowRequest(req *models.Request) (bool, *FailureToken, error) {
+	key := keyForIPRequest(req)
+	token := &FailureToken{limiter: f, key: key}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	b, tracked := f.inner.IPRateBuckets[key]
+	if !tracked {
+		return true, token, nil
+	}
+
+	sum := 0
+	for _, c := range b {
+		sum += c
+	}
+
+	if sum >= f.MaxRequestsPerWindow {
+		return false, token, ErrIPWindowLimitExceeded
+	}
+
+	if b[f.inner.curBucket] >= f.MaxRequestsPerBucket {
+		return false, token, ErrIPBucketLimitExceeded
+	}
+
+	return true, token, nil
+}
+
+// registerFailure records a failure for key, creating its bucket on first
+// use.
+func (f *FailureRateLimiter) registerFailure(key string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	b, ok := f.inner.IPRateBuckets[key]
+	if !ok {
+		b = make([]int, f.inner.NumberBuckets)
+		f.inner.IPRateBuckets[key] = b
+		f.metrics.ipRateBucketsGauge.Inc()
+	}
+
+	b[f.inner.curBucket]++
+}
+
+// Tick advances the underlying bucket clock, aging out IPs that haven't
+// failed recently.
+func (f *FailureRateLimiter) Tick() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.inner.Tick()
+}
@@ -0,0 +1,67 @@
+// Lophiid distributed honeypot
+// Copyright (C) 2024 Niels Heinen
+//
+// This program is free software; you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the
+// Free Software Foundation; either version 2 of the License, or (at your
+// option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of MERCHANTABILITY
+// or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License
+// for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, write to the Free Software Foundation, Inc.,
+// 59 Temple Place, Suite 330, Boston, MA 02111-1307 USA
+package ratelimit
+
+import (
+	"lophiid/pkg/database/models"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestFailureRateLimiterIgnoresSuccessfulRequests(t *testing.T) {
+	f := NewFailureRateLimiter(time.Second*5, time.Second, 2, 1, CreateRatelimiterMetrics(prometheus.NewRegistry()))
+	req := &models.Request{HoneypotIP: "10.0.0.1", Port: 8080, SourceIP: "192.168.1.1"}
+
+	for i := 0; i < 10; i++ {
+		allowed, token, err := f.AllowRequest(req)
+		if !allowed || err != nil {
+			t.Fatalf("request %d: got allowed=%v err=%v, want true, nil", i, allowed, err)
+		}
+		token.Commit(true)
+	}
+
+	if _, tracked := f.inner.IPRateBuckets[keyForIPRequest(req)]; tracked {
+		t.Errorf("a bucket should not be created for an IP that never failed")
+	}
+}
+
+func TestFailureRateLimiterThrottlesAfterFailure(t *testing.T) {
+	f := NewFailureRateLimiter(time.Second*5, time.Second, 5, 2, CreateRatelimiterMetrics(prometheus.NewRegistry()))
+	req := &models.Request{HoneypotIP: "10.0.0.1", Port: 8080, SourceIP: "192.168.1.1"}
+
+	allowed, token, err := f.AllowRequest(req)
+	if !allowed || err != nil {
+		t.Fatalf("first request should be allowed, got %v, %v", allowed, err)
+	}
+	token.Commit(false)
+
+	allowed, token, err = f.AllowRequest(req)
+	if !allowed || err != nil {
+		t.Fatalf("second request should still be allowed, got %v, %v", allowed, err)
+	}
+	token.Commit(false)
+
+	allowed, _, err = f.AllowRequest(req)
+	if allowed {
+		t.Errorf("third request should be throttled after two failures")
+	}
+	if err != ErrIPBucketLimitExceeded {
+		t.Errorf("expected ErrIPBucketLimitExceeded, got %v", err)
+	}
+}
@@ -0,0 +1,177 @@
+// Lophiid distributed honeypot
+// Copyright (C) 2024 Niels Heinen
+//
+// This program is free software; you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the
+// Free Software Foundation; either version 2 of the License, or (at your
+// option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of MERCHANTABILITY
+// or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License
+// for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, write to the Free Software Foundation, Inc.,
+// 59 Temple Place, Suite 330, Boston, MA 02111-1307 USA
+package ratelimit
+
+import (
+	"errors"
+	"lophiid/pkg/database/models"
+	"sync"
+)
+
+var (
+	ErrSessionRequestLimitExceeded = errors.New("session request limit exceeded")
+	ErrSessionRuleLimitExceeded    = errors.New("session rule limit exceeded")
+)
+
+// Stage is a single named step in a MultiStageRateLimiter pipeline.
+type Stage struct {
+	Name    string
+	Limiter RateLimiter
+}
+
+// MultiStageRateLimiter evaluates a request against an ordered list of
+// stages (e.g. per-source-IP -> per-/24-subnet -> per-URI-hash ->
+// per-honeypot-global) and rejects on the first stage that does. Stages are
+// supplied by the caller so operators can reorder or disable them via
+// config without recompiling.
+type MultiStageRateLimiter struct {
+	Stages []Stage
+}
+
+// NewMultiStageRateLimiter builds a MultiStageRateLimiter that evaluates
+// stages in order.
+func NewMultiStageRateLimiter(stages ...Stage) *MultiStageRateLimiter {
+	return &MultiStageRateLimiter{Stages: stages}
+}
+
+// StageConfig describes a single stage to wire into a MultiStageRateLimiter.
+// A slice of these is the config-driven equivalent of hand-writing
+// NewMultiStageRateLimiter(Stage{...}, ...): operators can reorder the
+// slice or flip Enabled to change which stages run and in what order,
+// without recompiling.
+type StageConfig struct {
+	// Name identifies the stage for logging/metrics, same as Stage.Name.
+	Name string
+	// Enabled lets an operator disable a stage via config without
+	// removing it from the list.
+	Enabled bool
+	// Limiter is the RateLimiter backing this stage. It's supplied
+	// pre-built, since the concrete limiter type and its own parameters
+	// (window sizes, peers, session provider, ...) vary per stage.
+	Limiter RateLimiter
+}
+
+// NewMultiStageRateLimiterFromConfig builds a MultiStageRateLimiter from
+// stages, preserving their order and skipping any that are disabled.
+func NewMultiStageRateLimiterFromConfig(stages []StageConfig) *MultiStageRateLimiter {
+	m := &MultiStageRateLimiter{}
+
+	for _, sc := range stages {
+		if !sc.Enabled {
+			continue
+		}
+		m.Stages = append(m.Stages, Stage{Name: sc.Name, Limiter: sc.Limiter})
+	}
+
+	return m
+}
+
+// AllowRequest runs req through each stage in order. It returns the name of
+// the stage that rejected it, or an empty string if req is allowed by all
+// stages.
+func (m *MultiStageRateLimiter) AllowRequest(req *models.Request) (bool, string, error) {
+	for _, stage := range m.Stages {
+		if allowed, err := stage.Limiter.AllowRequest(req); !allowed {
+			return false, stage.Name, err
+		}
+	}
+
+	return true, "", nil
+}
+
+// Tick advances every stage's internal clock.
+func (m *MultiStageRateLimiter) Tick() {
+	for _, stage := range m.Stages {
+		stage.Limiter.Tick()
+	}
+}
+
+// SessionProvider resolves a session ID to the live *models.Session, so
+// SessionRateLimiter can inspect Session.RuleIDsServed without owning
+// session storage itself.
+type SessionProvider interface {
+	SessionByID(id int64) (*models.Session, bool)
+}
+
+var _ RateLimiter = (*SessionRateLimiter)(nil)
+
+// SessionRateLimiter caps the total number of requests and the number of
+// unique rules served within a single attacker session, so long-lived
+// sessions get throttled independently of their raw per-IP request rate.
+type SessionRateLimiter struct {
+	Sessions              SessionProvider
+	MaxRequestsPerSession int
+	MaxRulesPerSession    int
+
+	mu       sync.Mutex
+	requests map[int64]int
+}
+
+// NewSessionRateLimiter creates a SessionRateLimiter that resolves sessions
+// through sessions and caps them at maxRequestsPerSession requests and
+// maxRulesPerSession unique rules served.
+func NewSessionRateLimiter(sessions SessionProvider, maxRequestsPerSession int, maxRulesPerSession int) *SessionRateLimiter {
+	return &SessionRateLimiter{
+		Sessions:              sessions,
+		MaxRequestsPerSession: maxRequestsPerSession,
+		MaxRulesPerSession:    maxRulesPerSession,
+		requests:              make(map[int64]int),
+	}
+}
+
+// AllowRequest looks up req.SessionID and rejects once that session has
+// exceeded its request or served-rule caps. Requests without a known
+// session are always allowed.
+func (s *SessionRateLimiter) AllowRequest(req *models.Request) (bool, error) {
+	session, ok := s.Sessions.SessionByID(req.SessionID)
+	if !ok {
+		return true, nil
+	}
+
+	s.mu.Lock()
+	s.requests[session.ID]++
+	count := s.requests[session.ID]
+	s.mu.Unlock()
+
+	if count > s.MaxRequestsPerSession {
+		return false, ErrSessionRequestLimitExceeded
+	}
+
+	session.Mu.RLock()
+	rulesServed := len(session.RuleIDsServed)
+	session.Mu.RUnlock()
+
+	if rulesServed > s.MaxRulesPerSession {
+		return false, ErrSessionRuleLimitExceeded
+	}
+
+	return true, nil
+}
+
+// Tick drops request counters for sessions that have since ended, keeping
+// memory bounded. It satisfies the RateLimiter interface.
+func (s *SessionRateLimiter) Tick() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for id := range s.requests {
+		session, ok := s.Sessions.SessionByID(id)
+		if !ok || !session.EndedAt.IsZero() {
+			delete(s.requests, id)
+		}
+	}
+}
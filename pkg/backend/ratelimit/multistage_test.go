@@ -0,0 +1,154 @@
+// Lophiid distributed honeypot
+// Copyright (C) 2024 Niels Heinen
+//
+// This program is free software; you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the
+// Free Software Foundation; either version 2 of the License, or (at your
+// option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of MERCHANTABILITY
+// or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License
+// for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, write to the Free Software Foundation, Inc.,
+// 59 Temple Place, Suite 330, Boston, MA 02111-1307 USA
+package ratelimit
+
+import (
+	"errors"
+	"lophiid/pkg/database/models"
+	"testing"
+)
+
+type fakeStageLimiter struct {
+	allow bool
+	err   error
+	ticks int
+}
+
+func (f *fakeStageLimiter) AllowRequest(_ *models.Request) (bool, error) { return f.allow, f.err }
+func (f *fakeStageLimiter) Tick()                                        { f.ticks++ }
+
+func TestMultiStageRateLimiterRejectsOnFirstFailingStage(t *testing.T) {
+	first := &fakeStageLimiter{allow: true}
+	second := &fakeStageLimiter{allow: false, err: errors.New("nope")}
+	third := &fakeStageLimiter{allow: true}
+
+	m := NewMultiStageRateLimiter(
+		Stage{Name: "ip", Limiter: first},
+		Stage{Name: "uri", Limiter: second},
+		Stage{Name: "global", Limiter: third},
+	)
+
+	allowed, stage, err := m.AllowRequest(&models.Request{})
+	if allowed {
+		t.Fatalf("expected request to be rejected")
+	}
+	if stage != "uri" {
+		t.Errorf("expected rejecting stage to be %q, got %q", "uri", stage)
+	}
+	if err == nil {
+		t.Errorf("expected an error from the rejecting stage")
+	}
+}
+
+func TestNewMultiStageRateLimiterFromConfigSkipsDisabledStages(t *testing.T) {
+	ip := &fakeStageLimiter{allow: true}
+	uri := &fakeStageLimiter{allow: false, err: errors.New("nope")}
+	global := &fakeStageLimiter{allow: true}
+
+	m := NewMultiStageRateLimiterFromConfig([]StageConfig{
+		{Name: "ip", Enabled: true, Limiter: ip},
+		{Name: "uri", Enabled: false, Limiter: uri},
+		{Name: "global", Enabled: true, Limiter: global},
+	})
+
+	if len(m.Stages) != 2 {
+		t.Fatalf("expected 2 enabled stages, got %d", len(m.Stages))
+	}
+	if m.Stages[0].Name != "ip" || m.Stages[1].Name != "global" {
+		t.Errorf("expected stage order [ip, global], got [%s, %s]", m.Stages[0].Name, m.Stages[1].Name)
+	}
+
+	// The disabled "uri" stage would reject every request; since it's
+	// skipped the request must be allowed.
+	allowed, stage, err := m.AllowRequest(&models.Request{})
+	if !allowed || stage != "" || err != nil {
+		t.Errorf("expected the request to be allowed with the uri stage disabled, got %v, %q, %v", allowed, stage, err)
+	}
+}
+
+func TestMultiStageRateLimiterTicksAllStages(t *testing.T) {
+	first := &fakeStageLimiter{allow: true}
+	second := &fakeStageLimiter{allow: true}
+
+	m := NewMultiStageRateLimiter(Stage{Name: "ip", Limiter: first}, Stage{Name: "uri", Limiter: second})
+	m.Tick()
+
+	if first.ticks != 1 || second.ticks != 1 {
+		t.Errorf("expected every stage to be ticked once, got %d and %d", first.ticks, second.ticks)
+	}
+}
+
+type fakeSessionProvider struct {
+	sessions map[int64]*models.Session
+}
+
+func (f *fakeSessionProvider) SessionByID(id int64) (*models.Session, bool) {
+	s, ok := f.sessions[id]
+	return s, ok
+}
+
+func TestSessionRateLimiterCapsRequestsPerSession(t *testing.T) {
+	session := models.NewSession()
+	session.ID = 1
+
+	provider := &fakeSessionProvider{sessions: map[int64]*models.Session{1: session}}
+	s := NewSessionRateLimiter(provider, 2, 10)
+
+	req := &models.Request{SessionID: 1}
+
+	for i := 0; i < 2; i++ {
+		if allowed, err := s.AllowRequest(req); !allowed {
+			t.Fatalf("request %d should be allowed, got err %v", i, err)
+		}
+	}
+
+	allowed, err := s.AllowRequest(req)
+	if allowed {
+		t.Errorf("third request should exceed the session request cap")
+	}
+	if err != ErrSessionRequestLimitExceeded {
+		t.Errorf("expected ErrSessionRequestLimitExceeded, got %v", err)
+	}
+}
+
+func TestSessionRateLimiterCapsRulesServedPerSession(t *testing.T) {
+	session := models.NewSession()
+	session.ID = 1
+	session.ServedRuleWithContent(1, 100)
+	session.ServedRuleWithContent(2, 200)
+
+	provider := &fakeSessionProvider{sessions: map[int64]*models.Session{1: session}}
+	s := NewSessionRateLimiter(provider, 100, 1)
+
+	allowed, err := s.AllowRequest(&models.Request{SessionID: 1})
+	if allowed {
+		t.Errorf("request should be rejected, session already served more rules than the cap")
+	}
+	if err != ErrSessionRuleLimitExceeded {
+		t.Errorf("expected ErrSessionRuleLimitExceeded, got %v", err)
+	}
+}
+
+func TestSessionRateLimiterAllowsUnknownSession(t *testing.T) {
+	provider := &fakeSessionProvider{sessions: map[int64]*models.Session{}}
+	s := NewSessionRateLimiter(provider, 0, 0)
+
+	allowed, err := s.AllowRequest(&models.Request{SessionID: 42})
+	if !allowed || err != nil {
+		t.Errorf("requests for an unknown session should be allowed, got %v, %v", allowed, err)
+	}
+}
@@ -0,0 +1,245 @@
+// Lophiid distributed honeypot
+// Copyright (C) 2024 Niels Heinen
+//
+// This program is free software; you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the
+// Free Software Foundation; either version 2 of the License, or (at your
+// option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of MERCHANTABILITY
+// or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License
+// for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, write to the Free Software Foundation, Inc.,
+// 59 Temple Place, Suite 330, Boston, MA 02111-1307 USA
+package ratelimit
+
+import (
+	"errors"
+	"fmt"
+	"lophiid/pkg/database/models"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	ErrIPBucketLimitExceeded  = errors.New("ip bucket limit exceeded")
+	ErrIPWindowLimitExceeded  = errors.New("ip window limit exceeded")
+	ErrURIBucketLimitExceeded = errors.New("uri bucket limit exceeded")
+	ErrURIWindowLimitExceeded = errors.New("uri window limit exceeded")
+)
+
+// RateLimiter decides whether a request coming in on a honeypot backend is
+// allowed to proceed. WindowRateLimiter keeps its bookkeeping in-process;
+// ClusterRateLimiter delegates the authoritative count to whichever peer in
+// the fleet owns the request's key.
+type RateLimiter interface {
+	// AllowRequest returns whether req is allowed and, if not, the error
+	// explaining which limit was hit.
+	AllowRequest(req *models.Request) (bool, error)
+	// Tick runs the limiter's periodic housekeeping; for WindowRateLimiter
+	// that advances its internal clock by one bucket duration. Callers are
+	// expected to invoke this on a timer.
+	Tick()
+}
+
+var _ RateLimiter = (*WindowRateLimiter)(nil)
+
+// RateLimiterMetrics holds the Prometheus collectors shared by the
+// limiters in this package.
+type RateLimiterMetrics struct {
+	ipRateBucketsGauge  prometheus.Gauge
+	uriRateBucketsGauge prometheus.Gauge
+}
+
+// CreateRatelimiterMetrics registers and returns the rate limiter metrics
+// on reg.
+func CreateRatelimiterMetrics(reg prometheus.Registerer) *RateLimiterMetrics {
+	m := &RateLimiterMetrics{
+		ipRateBucketsGauge: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "lophiid_ratelimit_ip_buckets",
+			Help: "Number of source IPs that currently have an active rate limit bucket",
+		}),
+		uriRateBucketsGauge: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "lophiid_ratelimit_uri_buckets",
+			Help: "Number of URIs that currently have an active rate limit bucket",
+		}),
+	}
+
+	reg.MustRegister(m.ipRateBucketsGauge)
+	reg.MustRegister(m.uriRateBucketsGauge)
+	return m
+}
+
+// WindowRateLimiter buckets requests per source-IP and per-URI into fixed
+// size time buckets that together make up a sliding window. Each key (IP or
+// URI) is rejected once either its current bucket or its whole window fills
+// up.
+type WindowRateLimiter struct {
+	Window         time.Duration
+	BucketDuration time.Duration
+	NumberBuckets  int
+
+	MaxIPRequestsPerWindow  int
+	MaxIPRequestsPerBucket  int
+	MaxURIRequestsPerWindow int
+	MaxURIRequestsPerBucket int
+
+	IPRateBuckets  map[string][]int
+	URIRateBuckets map[string][]int
+
+	// ipMode/uriMode select between the default sliding window above and
+	// token-bucket mode (see tokenbucket.go). They default to
+	// RateLimitModeWindow and are switched via EnableIPTokenBucket /
+	// EnableURITokenBucket.
+	ipMode          RateLimitMode
+	uriMode         RateLimitMode
+	ipTokenRate     float64
+	ipTokenBurst    int
+	uriTokenRate    float64
+	uriTokenBurst   int
+	IPTokenBuckets  map[string]*tokenBucket
+	URITokenBuckets map[string]*tokenBucket
+
+	curBucket int
+	metrics   *RateLimiterMetrics
+}
+
+// NewWindowRateLimiter creates a WindowRateLimiter that keeps window/bucketDuration
+// buckets per key and rejects a key once it exceeds maxPerBucket requests in
+// its current bucket or maxPerWindow requests across the whole window.
+func NewWindowRateLimiter(window time.Duration, bucketDuration time.Duration, maxIPRequestsPerWindow int, maxIPRequestsPerBucket int, maxURIRequestsPerWindow int, maxURIRequestsPerBucket int, metrics *RateLimiterMetrics) *WindowRateLimiter {
+	return &WindowRateLimiter{
+		Window:                  window,
+		BucketDuration:          bucketDuration,
+		NumberBuckets:           int(window / bucketDuration),
+		MaxIPRequestsPerWindow:  maxIPRequestsPerWindow,
+		MaxIPRequestsPerBucket:  maxIPRequestsPerBucket,
+		MaxURIRequestsPerWindow: maxURIRequestsPerWindow,
+		MaxURIRequestsPerBucket: maxURIRequestsPerBucket,
+		IPRateBuckets:           make(map[string][]int),
+		URIRateBuckets:          make(map[string][]int),
+		metrics:                 metrics,
+	}
+}
+
+// AllowRequest checks req against both the per-IP and per-URI buckets and
+// returns the first error encountered, if any.
+func (r *WindowRateLimiter) AllowRequest(req *models.Request) (bool, error) {
+	if allowed, err := r.allowRequestForIP(req); !allowed {
+		return false, err
+	}
+
+	if allowed, err := r.allowRequestForURI(req); !allowed {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// keyForIPRequest builds the per-IP rate limit key shared by all limiters
+// in this package: HoneypotIP-Port-SourceIP.
+func keyForIPRequest(req *models.Request) string {
+	return fmt.Sprintf("%s-%d-%s", req.HoneypotIP, req.Port, req.SourceIP)
+}
+
+func (r *WindowRateLimiter) allowRequestForIP(req *models.Request) (bool, error) {
+	key := keyForIPRequest(req)
+
+	if r.ipMode == RateLimitModeTokenBucket {
+		return r.allowTokenBucket(r.IPTokenBuckets, key, r.ipTokenRate, r.ipTokenBurst, r.metrics.ipRateBucketsGauge, ErrIPTokenBucketExhausted)
+	}
+
+	return r.registerHit(r.IPRateBuckets, key, r.MaxIPRequestsPerWindow, r.MaxIPRequestsPerBucket, r.metrics.ipRateBucketsGauge, ErrIPWindowLimitExceeded, ErrIPBucketLimitExceeded)
+}
+
+func (r *WindowRateLimiter) allowRequestForURI(req *models.Request) (bool, error) {
+	if r.uriMode == RateLimitModeTokenBucket {
+		return r.allowTokenBucket(r.URITokenBuckets, req.BaseHash, r.uriTokenRate, r.uriTokenBurst, r.metrics.uriRateBucketsGauge, ErrURITokenBucketExhausted)
+	}
+
+	return r.registerHit(r.URIRateBuckets, req.BaseHash, r.MaxURIRequestsPerWindow, r.MaxURIRequestsPerBucket, r.metrics.uriRateBucketsGauge, ErrURIWindowLimitExceeded, ErrURIBucketLimitExceeded)
+}
+
+// registerHit records a hit for key in buckets, creating the bucket slice on
+// first use, and checks it against the window and per-bucket caps. The hit
+// is always recorded, even when it ends up being rejected, so that repeated
+// offenders don't get a free pass by retrying.
+func (r *WindowRateLimiter) registerHit(buckets map[string][]int, key string, maxPerWindow int, maxPerBucket int, gauge prometheus.Gauge, windowErr error, bucketErr error) (bool, error) {
+	b, ok := buckets[key]
+	if !ok {
+		b = make([]int, r.NumberBuckets)
+		buckets[key] = b
+		gauge.Inc()
+	}
+
+	b[r.curBucket]++
+
+	sum := 0
+	for _, c := range b {
+		sum += c
+	}
+
+	if sum > maxPerWindow {
+		return false, windowErr
+	}
+
+	if b[r.curBucket] > maxPerBucket {
+		return false, bucketErr
+	}
+
+	return true, nil
+}
+
+// Tick advances the current bucket and evicts any key whose buckets have
+// all aged out of the window. Token-bucket keys don't live in
+// IPRateBuckets/URIRateBuckets, so Tick is a no-op for them beyond the
+// staleness sweep below, which evicts keys that haven't been refilled
+// (i.e. haven't seen a request) for a full window.
+func (r *WindowRateLimiter) Tick() {
+	r.curBucket = (r.curBucket + 1) % r.NumberBuckets
+
+	for key, b := range r.IPRateBuckets {
+		b[r.curBucket] = 0
+		if isZero(b) {
+			delete(r.IPRateBuckets, key)
+			r.metrics.ipRateBucketsGauge.Dec()
+		}
+	}
+
+	for key, b := range r.URIRateBuckets {
+		b[r.curBucket] = 0
+		if isZero(b) {
+			delete(r.URIRateBuckets, key)
+			r.metrics.uriRateBucketsGauge.Dec()
+		}
+	}
+
+	now := time.Now()
+
+	for key, b := range r.IPTokenBuckets {
+		if now.Sub(b.lastRefill) > r.Window {
+			delete(r.IPTokenBuckets, key)
+			r.metrics.ipRateBucketsGauge.Dec()
+		}
+	}
+
+	for key, b := range r.URITokenBuckets {
+		if now.Sub(b.lastRefill) > r.Window {
+			delete(r.URITokenBuckets, key)
+			r.metrics.uriRateBucketsGauge.Dec()
+		}
+	}
+}
+
+func isZero(buckets []int) bool {
+	for _, c := range buckets {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
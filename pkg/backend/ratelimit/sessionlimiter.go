@@ -0,0 +1,182 @@
+// Lophiid distributed honeypot
+// Copyright (C) 2024 Niels Heinen
+//
+// This program is free software; you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the
+// Free Software Foundation; either version 2 of the License, or (at your
+// option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of MERCHANTABILITY
+// or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License
+// for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, write to the Free Software Foundation, Inc.,
+// 59 Temple Place, Suite 330, Boston, MA 02111-1307 USA
+package ratelimit
+
+import (
+	"errors"
+	"lophiid/pkg/database/models"
+	"sort"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	// ErrSessionCapExceeded is returned when admitting a new session would
+	// push a honeypot backend past its concurrent-session ceiling.
+	ErrSessionCapExceeded = errors.New("concurrent session cap exceeded")
+	// ErrSessionDraining is returned for sessions that were selected for
+	// drain because the ceiling got lowered below the number of sessions
+	// that were active at the time.
+	ErrSessionDraining = errors.New("session is draining")
+)
+
+var _ RateLimiter = (*SessionLimiter)(nil)
+
+// SessionLimiterMetrics holds the Prometheus collectors for SessionLimiter.
+type SessionLimiterMetrics struct {
+	activeSessionsGauge prometheus.Gauge
+	sessionLimitGauge   prometheus.Gauge
+	drainEventsCounter  prometheus.Counter
+}
+
+// CreateSessionLimiterMetrics registers and returns the SessionLimiter
+// metrics on reg.
+func CreateSessionLimiterMetrics(reg prometheus.Registerer) *SessionLimiterMetrics {
+	m := &SessionLimiterMetrics{
+		activeSessionsGauge: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "lophiid_session_limiter_active_sessions",
+			Help: "Number of sessions currently tracked as active by the session limiter",
+		}),
+		sessionLimitGauge: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "lophiid_session_limiter_limit",
+			Help: "Configured maximum number of concurrent sessions",
+		}),
+		drainEventsCounter: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "lophiid_session_limiter_drain_events_total",
+			Help: "Number of sessions that have been selected for draining",
+		}),
+	}
+
+	reg.MustRegister(m.activeSessionsGauge, m.sessionLimitGauge, m.drainEventsCounter)
+	return m
+}
+
+// SessionLimiter enforces a ceiling on the number of concurrently active
+// sessions a honeypot backend will serve. When the ceiling is lowered below
+// the number of sessions currently active (config reload, or load
+// shedding), the oldest sessions by StartedAt are marked for drain (how
+// recently a session saw requests is not considered): further
+// requests for them are rejected with ErrSessionDraining so the frontend can
+// end the interaction cleanly via Session.EndedAt instead of dropping
+// mid-stream.
+type SessionLimiter struct {
+	mu       sync.Mutex
+	limit    int
+	sessions map[int64]*models.Session
+	draining map[int64]bool
+	metrics  *SessionLimiterMetrics
+}
+
+// NewSessionLimiter creates a SessionLimiter with an initial ceiling of
+// limit concurrent sessions.
+func NewSessionLimiter(limit int, metrics *SessionLimiterMetrics) *SessionLimiter {
+	metrics.sessionLimitGauge.Set(float64(limit))
+	return &SessionLimiter{
+		limit:    limit,
+		sessions: make(map[int64]*models.Session),
+		draining: make(map[int64]bool),
+		metrics:  metrics,
+	}
+}
+
+// SetLimit updates the concurrent session ceiling, e.g. on config reload or
+// in response to observed load. If the new limit is lower than the number
+// of sessions currently active, the ones with the earliest StartedAt are
+// marked for drain.
+func (s *SessionLimiter) SetLimit(limit int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.limit = limit
+	s.metrics.sessionLimitGauge.Set(float64(limit))
+	s.drainExcessLocked()
+}
+
+// Admit registers session as active, rejecting it with
+// ErrSessionCapExceeded if doing so would exceed the configured ceiling.
+func (s *SessionLimiter) Admit(session *models.Session) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.sessions) >= s.limit {
+		return false, ErrSessionCapExceeded
+	}
+
+	s.sessions[session.ID] = session
+	s.metrics.activeSessionsGauge.Set(float64(len(s.sessions)))
+	return true, nil
+}
+
+// Release marks a session as no longer active, e.g. once its
+// Session.EndedAt has been set.
+func (s *SessionLimiter) Release(sessionID int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.sessions, sessionID)
+	delete(s.draining, sessionID)
+	s.metrics.activeSessionsGauge.Set(float64(len(s.sessions)))
+}
+
+// AllowRequest is the admission check meant to run before the per-IP/URI
+// rate limiters in the same code path: it only rejects requests for
+// sessions that have been selected for drain. It satisfies the RateLimiter
+// interface so it composes naturally as a MultiStageRateLimiter stage.
+func (s *SessionLimiter) AllowRequest(req *models.Request) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.draining[req.SessionID] {
+		return false, ErrSessionDraining
+	}
+
+	return true, nil
+}
+
+// Tick re-evaluates the active set against the current limit, draining more
+// sessions if needed.
+func (s *SessionLimiter) Tick() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.drainExcessLocked()
+}
+
+// drainExcessLocked selects the oldest non-draining sessions for drain
+// until the active set is back within limit. Callers must hold s.mu.
+func (s *SessionLimiter) drainExcessLocked() {
+	candidates := make([]*models.Session, 0, len(s.sessions))
+	for _, session := range s.sessions {
+		if !s.draining[session.ID] {
+			candidates = append(candidates, session)
+		}
+	}
+
+	excess := len(candidates) - s.limit
+	if excess <= 0 {
+		return
+	}
+
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].StartedAt.Before(candidates[j].StartedAt)
+	})
+
+	for i := 0; i < excess && i < len(candidates); i++ {
+		s.draining[candidates[i].ID] = true
+		s.metrics.drainEventsCounter.Inc()
+	}
+}
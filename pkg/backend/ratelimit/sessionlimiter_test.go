@@ -0,0 +1,122 @@
+// Lophiid distributed honeypot
+// Copyright (C) 2024 Niels Heinen
+//
+// This program is free software; you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the
+// Free Software Foundation; either version 2 of the License, or (at your
+// option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of MERCHANTABILITY
+// or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License
+// for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, write to the Free Software Foundation, Inc.,
+// 59 Temple Place, Suite 330, Boston, MA 02111-1307 USA
+package ratelimit
+
+import (
+	"lophiid/pkg/database/models"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func newTestSession(id int64, startedAt time.Time) *models.Session {
+	s := models.NewSession()
+	s.ID = id
+	s.StartedAt = startedAt
+	return s
+}
+
+func TestSessionLimiterAdmitRespectsLimit(t *testing.T) {
+	l := NewSessionLimiter(2, CreateSessionLimiterMetrics(prometheus.NewRegistry()))
+
+	now := time.Now()
+	if allowed, err := l.Admit(newTestSession(1, now)); !allowed || err != nil {
+		t.Fatalf("1st session should be admitted, got %v, %v", allowed, err)
+	}
+	if allowed, err := l.Admit(newTestSession(2, now)); !allowed || err != nil {
+		t.Fatalf("2nd session should be admitted, got %v, %v", allowed, err)
+	}
+
+	allowed, err := l.Admit(newTestSession(3, now))
+	if allowed {
+		t.Errorf("3rd session should be rejected, the limit is 2")
+	}
+	if err != ErrSessionCapExceeded {
+		t.Errorf("expected ErrSessionCapExceeded, got %v", err)
+	}
+}
+
+func TestSessionLimiterDrainsOldestOnLoweredLimit(t *testing.T) {
+	l := NewSessionLimiter(3, CreateSessionLimiterMetrics(prometheus.NewRegistry()))
+
+	now := time.Now()
+	oldest := newTestSession(1, now.Add(-time.Minute))
+	middle := newTestSession(2, now.Add(-time.Second))
+	newest := newTestSession(3, now)
+
+	for _, s := range []*models.Session{oldest, middle, newest} {
+		if allowed, err := l.Admit(s); !allowed || err != nil {
+			t.Fatalf("session %d should be admitted, got %v, %v", s.ID, allowed, err)
+		}
+	}
+
+	l.SetLimit(1)
+
+	if allowed, err := l.AllowRequest(&models.Request{SessionID: oldest.ID}); allowed {
+		t.Errorf("oldest session should be draining after the limit was lowered, err=%v", err)
+	}
+	if allowed, err := l.AllowRequest(&models.Request{SessionID: middle.ID}); allowed {
+		t.Errorf("middle session should be draining after the limit was lowered, err=%v", err)
+	}
+	if allowed, err := l.AllowRequest(&models.Request{SessionID: newest.ID}); !allowed || err != nil {
+		t.Errorf("newest session should not be draining, got %v, %v", allowed, err)
+	}
+}
+
+func TestSessionLimiterRepeatedTickDoesNotOverDrain(t *testing.T) {
+	l := NewSessionLimiter(3, CreateSessionLimiterMetrics(prometheus.NewRegistry()))
+
+	now := time.Now()
+	oldest := newTestSession(1, now.Add(-time.Minute))
+	middle := newTestSession(2, now.Add(-time.Second))
+	newest := newTestSession(3, now)
+
+	for _, s := range []*models.Session{oldest, middle, newest} {
+		if allowed, err := l.Admit(s); !allowed || err != nil {
+			t.Fatalf("session %d should be admitted, got %v, %v", s.ID, allowed, err)
+		}
+	}
+
+	l.SetLimit(1)
+	// A second reconciliation pass (e.g. the periodic Tick(), or another
+	// config reload applying the same limit) must not drain further
+	// sessions beyond what's already needed to reach the limit.
+	l.Tick()
+	l.Tick()
+
+	if allowed, err := l.AllowRequest(&models.Request{SessionID: newest.ID}); !allowed || err != nil {
+		t.Errorf("newest session should still not be draining after repeated ticks, got %v, %v", allowed, err)
+	}
+}
+
+func TestSessionLimiterReleaseFreesCapacity(t *testing.T) {
+	l := NewSessionLimiter(1, CreateSessionLimiterMetrics(prometheus.NewRegistry()))
+
+	now := time.Now()
+	first := newTestSession(1, now)
+	if allowed, err := l.Admit(first); !allowed || err != nil {
+		t.Fatalf("first session should be admitted, got %v, %v", allowed, err)
+	}
+
+	l.Release(first.ID)
+
+	second := newTestSession(2, now)
+	if allowed, err := l.Admit(second); !allowed || err != nil {
+		t.Errorf("session should be admitted after the previous one was released, got %v, %v", allowed, err)
+	}
+}
@@ -0,0 +1,133 @@
+// Lophiid distributed honeypot
+// Copyright (C) 2024 Niels Heinen
+//
+// This program is free software; you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the
+// Free Software Foundation; either version 2 of the License, or (at your
+// option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of MERCHANTABILITY
+// or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License
+// for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, write to the Free Software Foundation, Inc.,
+// 59 Temple Place, Suite 330, Boston, MA 02111-1307 USA
+package ratelimit
+
+import (
+	"errors"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	ErrIPTokenBucketExhausted  = errors.New("ip token bucket exhausted")
+	ErrURITokenBucketExhausted = errors.New("uri token bucket exhausted")
+)
+
+// RateLimitMode selects the algorithm a WindowRateLimiter uses for IP or URI
+// keys.
+type RateLimitMode int
+
+const (
+	// RateLimitModeWindow is the default fixed-bucket sliding window mode.
+	RateLimitModeWindow RateLimitMode = iota
+	// RateLimitModeTokenBucket refills a per-key budget continuously
+	// instead of resetting it on bucket boundaries, which is gentler on
+	// bursty but otherwise low-rate clients.
+	RateLimitModeTokenBucket
+)
+
+// tokenBucket is the per-key state for token-bucket mode: tokens holds the
+// currently available budget and lastRefill is when it was last topped up.
+type tokenBucket struct {
+	tokens     float64
+	lastRefill time.Time
+}
+
+// EnableIPTokenBucket switches IP-keyed rate limiting from window mode to
+// token-bucket mode, refilling at ratePerSecond tokens per second up to a
+// maximum of burst.
+func (r *WindowRateLimiter) EnableIPTokenBucket(ratePerSecond float64, burst int) {
+	r.ipMode = RateLimitModeTokenBucket
+	r.ipTokenRate = ratePerSecond
+	r.ipTokenBurst = burst
+	r.IPTokenBuckets = make(map[string]*tokenBucket)
+}
+
+// EnableURITokenBucket switches URI-keyed rate limiting from window mode to
+// token-bucket mode, refilling at ratePerSecond tokens per second up to a
+// maximum of burst.
+func (r *WindowRateLimiter) EnableURITokenBucket(ratePerSecond float64, burst int) {
+	r.uriMode = RateLimitModeTokenBucket
+	r.uriTokenRate = ratePerSecond
+	r.uriTokenBurst = burst
+	r.URITokenBuckets = make(map[string]*tokenBucket)
+}
+
+// allowTokenBucket lazily refills the bucket for key based on elapsed time
+// since its last refill, then deducts one token if available.
+func (r *WindowRateLimiter) allowTokenBucket(buckets map[string]*tokenBucket, key string, ratePerSecond float64, burst int, gauge prometheus.Gauge, exhaustedErr error) (bool, error) {
+	now := time.Now()
+
+	b, ok := buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: float64(burst), lastRefill: now}
+		buckets[key] = b
+		gauge.Inc()
+	}
+
+	elapsed := now.Sub(b.lastRefill).Seconds()
+	b.tokens += elapsed * ratePerSecond
+	if b.tokens > float64(burst) {
+		b.tokens = float64(burst)
+	}
+	b.lastRefill = now
+
+	if b.tokens < 1 {
+		return false, exhaustedErr
+	}
+
+	b.tokens--
+	return true, nil
+}
+
+// Config describes how to build a WindowRateLimiter, including whether IP
+// and/or URI keys should use token-bucket mode instead of the default
+// sliding window.
+type Config struct {
+	Window         time.Duration
+	BucketDuration time.Duration
+
+	MaxIPRequestsPerWindow  int
+	MaxIPRequestsPerBucket  int
+	MaxURIRequestsPerWindow int
+	MaxURIRequestsPerBucket int
+
+	IPMode  RateLimitMode
+	URIMode RateLimitMode
+
+	IPRatePerSecond  float64
+	IPBurstSize      int
+	URIRatePerSecond float64
+	URIBurstSize     int
+}
+
+// NewWindowRateLimiterFromConfig builds a WindowRateLimiter from cfg,
+// enabling token-bucket mode for IP and/or URI keys where configured.
+func NewWindowRateLimiterFromConfig(cfg Config, metrics *RateLimiterMetrics) *WindowRateLimiter {
+	r := NewWindowRateLimiter(cfg.Window, cfg.BucketDuration, cfg.MaxIPRequestsPerWindow, cfg.MaxIPRequestsPerBucket, cfg.MaxURIRequestsPerWindow, cfg.MaxURIRequestsPerBucket, metrics)
+
+	if cfg.IPMode == RateLimitModeTokenBucket {
+		r.EnableIPTokenBucket(cfg.IPRatePerSecond, cfg.IPBurstSize)
+	}
+
+	if cfg.URIMode == RateLimitModeTokenBucket {
+		r.EnableURITokenBucket(cfg.URIRatePerSecond, cfg.URIBurstSize)
+	}
+
+	return r
+}
@@ -0,0 +1,88 @@
+// Lophiid distributed honeypot
+// Copyright (C) 2024 Niels Heinen
+//
+// This program is free software; you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the
+// Free Software Foundation; either version 2 of the License, or (at your
+// option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of MERCHANTABILITY
+// or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License
+// for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, write to the Free Software Foundation, Inc.,
+// 59 Temple Place, Suite 330, Boston, MA 02111-1307 USA
+package ratelimit
+
+import (
+	"lophiid/pkg/database/models"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestIPTokenBucketExhaustsAtBurst(t *testing.T) {
+	r := NewWindowRateLimiter(time.Second*5, time.Second, 100, 100, 100, 100, CreateRatelimiterMetrics(prometheus.NewRegistry()))
+	r.EnableIPTokenBucket(1, 2)
+
+	req := &models.Request{HoneypotIP: "10.0.0.1", Port: 8080, SourceIP: "192.168.1.1"}
+
+	if allowed, err := r.AllowRequest(req); !allowed {
+		t.Fatalf("1st request should be allowed, got err %v", err)
+	}
+
+	if allowed, err := r.AllowRequest(req); !allowed {
+		t.Fatalf("2nd request should be allowed by burst, got err %v", err)
+	}
+
+	allowed, err := r.AllowRequest(req)
+	if allowed {
+		t.Errorf("3rd request should be rejected once burst is exhausted")
+	}
+
+	if err != ErrIPTokenBucketExhausted {
+		t.Errorf("expected ErrIPTokenBucketExhausted, got %v", err)
+	}
+}
+
+func TestURITokenBucketIndependentFromIPMode(t *testing.T) {
+	r := NewWindowRateLimiter(time.Second*5, time.Second, 1, 1, 100, 100, CreateRatelimiterMetrics(prometheus.NewRegistry()))
+	r.EnableURITokenBucket(1, 1)
+
+	req := &models.Request{HoneypotIP: "10.0.0.1", Port: 8080, SourceIP: "192.168.1.1", BaseHash: "hash1"}
+
+	if allowed, err := r.allowRequestForURI(req); !allowed {
+		t.Fatalf("1st URI request should be allowed, got err %v", err)
+	}
+
+	if allowed, err := r.allowRequestForURI(req); allowed {
+		t.Errorf("2nd URI request should be rejected, got err %v", err)
+	}
+
+	if _, ok := r.URITokenBuckets["hash1"]; !ok {
+		t.Errorf("expected a token bucket to be tracked for hash1")
+	}
+}
+
+func TestTickEvictsStaleTokenBuckets(t *testing.T) {
+	r := NewWindowRateLimiter(time.Second*5, time.Second, 100, 100, 100, 100, CreateRatelimiterMetrics(prometheus.NewRegistry()))
+	r.EnableIPTokenBucket(1, 1)
+
+	req := &models.Request{HoneypotIP: "10.0.0.1", Port: 8080, SourceIP: "192.168.1.1"}
+	if allowed, err := r.AllowRequest(req); !allowed {
+		t.Fatalf("unexpected error seeding the bucket: %v", err)
+	}
+
+	// Simulate the bucket having gone stale by backdating its last refill
+	// past the window.
+	r.IPTokenBuckets[keyForIPRequest(req)].lastRefill = time.Now().Add(-2 * r.Window)
+
+	r.Tick()
+
+	if _, ok := r.IPTokenBuckets[keyForIPRequest(req)]; ok {
+		t.Errorf("expected stale token bucket to be evicted by Tick()")
+	}
+}
@@ -0,0 +1,38 @@
+// Lophiid distributed honeypot
+// Copyright (C) 2024 Niels Heinen
+//
+// This program is free software; you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the
+// Free Software Foundation; either version 2 of the License, or (at your
+// option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of MERCHANTABILITY
+// or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License
+// for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, write to the Free Software Foundation, Inc.,
+// 59 Temple Place, Suite 330, Boston, MA 02111-1307 USA
+package models
+
+import (
+	"time"
+)
+
+// Request represents a single HTTP request that was captured by one of the
+// honeypot backends.
+type Request struct {
+	ID         int64     `ksql:"id,skipInserts" json:"id" doc:"Database ID for the request"`
+	HoneypotIP string    `ksql:"honeypot_ip" json:"honeypot_ip" doc:"IP of the honeypot backend that received the request"`
+	Port       int       `ksql:"port" json:"port" doc:"Port the request came in on"`
+	SourceIP   string    `ksql:"source_ip" json:"source_ip" doc:"IP of the client that sent the request"`
+	Method     string    `ksql:"method" json:"method" doc:"HTTP method of the request"`
+	Uri        string    `ksql:"uri" json:"uri" doc:"URI that was requested"`
+	BaseHash   string    `ksql:"base_hash" json:"base_hash" doc:"Hash grouping requests that have a similar shape together"`
+	SessionID  int64     `ksql:"session_id" json:"session_id" doc:"ID of the session this request belongs to"`
+	CreatedAt  time.Time `ksql:"created_at,skipInserts,skipUpdates" json:"created_at" doc:"Creation date of the request in the database"`
+	UpdatedAt  time.Time `ksql:"updated_at,timeNowUTC" json:"updated_at" doc:"Date and time of last update"`
+}
+
+func (r *Request) ModelID() int64 { return r.ID }